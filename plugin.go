@@ -5,9 +5,13 @@ import (
 	"errors"
 	"fmt"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 	"gorm.io/gorm"
 )
 
@@ -23,14 +27,22 @@ const (
 	ActionRow    Action = "row"
 	ActionRaw    Action = "raw"
 
-	GormMetricsContextKey = "gorm_metrics_context"
-	GormMetricName        = "gorm_metrics_duration_seconds"
+	GormMetricsContextKey   = "gorm_metrics_context"
+	GormMetricName          = "gorm_metrics_duration_seconds"
+	GormMetricNameErrorKind = "gorm_metrics_error_kind_duration_seconds"
+	InFlightMetricName      = "gorm_metrics_in_flight"
+	RowsAffectedMetricName  = "gorm_metrics_rows_affected_total"
 
-	labelName    = "name"
-	labelAction  = "action"
-	labelModel   = "model"
-	labelJoins   = "joins"
-	labelOutcome = "outcome"
+	// defaultJanitorInterval is how often the TTL janitor sweeps for stale
+	// label combinations when GormMetrics.JanitorInterval is unset.
+	defaultJanitorInterval = time.Minute
+
+	labelName      = "name"
+	labelAction    = "action"
+	labelModel     = "model"
+	labelJoins     = "joins"
+	labelOutcome   = "outcome"
+	labelErrorKind = "error_kind"
 
 	outcomeSuccess = "success"
 	outcomeError   = "error"
@@ -44,17 +56,157 @@ var MetricLabels = []string{
 	labelOutcome,
 }
 
+// MetricLabelsWithErrorKind is MetricLabels plus the error_kind label
+// emitted by the label function DefaultWithErrorKind() configures. Only use
+// this label set with a GormMetrics whose LabelFn also emits error_kind.
+var MetricLabelsWithErrorKind = append(append([]string{}, MetricLabels...), labelErrorKind)
+
+// InFlightLabels are the labels used by GormMetrics.InFlightGauge. Unlike
+// MetricLabels, it omits joins/outcome since neither is known while a
+// statement is still in flight.
+var InFlightLabels = []string{
+	labelName,
+	labelAction,
+	labelModel,
+}
+
+// MetricType identifies the Prometheus collector type a CustomMetric
+// should be registered as.
+type MetricType string
+
+const (
+	MetricTypeHistogram MetricType = "histogram"
+	MetricTypeSummary   MetricType = "summary"
+	MetricTypeCounter   MetricType = "counter"
+	MetricTypeGauge     MetricType = "gauge"
+)
+
+// CustomMetric describes an additional metric GormMetrics should populate
+// alongside the duration histogram. It does not replace HistogramVec, which
+// is still observed on every callback and must be set. It is registered with
+// GormMetrics.Registerer during Initialize and observed by every callback
+// for which Filter returns true.
+type CustomMetric struct {
+	// Type selects the Prometheus collector kind to create.
+	Type MetricType
+	// Name and Help are passed through to the underlying prometheus.*Opts.
+	Name string
+	Help string
+	// Labels are the label names for the metric's vector. Defaults to
+	// MetricLabels when left nil.
+	Labels []string
+	// Buckets is used when Type is MetricTypeHistogram. Defaults to
+	// prometheus.DefBuckets when nil.
+	Buckets []float64
+	// Objectives is used when Type is MetricTypeSummary.
+	Objectives map[float64]float64
+
+	// LabelFn overrides GormMetrics.LabelFn for this metric. Leave nil to
+	// reuse the GormMetrics-level LabelFn.
+	LabelFn func(*gorm.DB, Action) []string
+	// Filter restricts which callback invocations observe this metric,
+	// e.g. only ActionUpdate/ActionDelete, or only when db.Error != nil.
+	// Leave nil to observe on every matching callback.
+	Filter func(db *gorm.DB, action Action) bool
+	// Value computes the number recorded against this metric: Observe for
+	// Histogram/Summary, Add for Counter, Set for Gauge. Leave nil to use
+	// the default for Type: elapsed seconds for Histogram/Summary, 1 for
+	// Counter. Gauge has no sane default and must set Value explicitly.
+	Value func(db *gorm.DB, action Action, elapsed float64) float64
+
+	vec prometheus.Collector
+}
+
+// Collector returns the Prometheus collector registered for this
+// CustomMetric, or nil if Initialize has not run yet. Useful for tests and
+// for callers that want to inspect the metric directly.
+func (cm *CustomMetric) Collector() prometheus.Collector {
+	return cm.vec
+}
+
 type GormMetrics struct {
 	gorm.Plugin
 
 	// HistogramVec is a Prometheus histogram vector to track the duration of GORM operations.
 	HistogramVec *prometheus.HistogramVec
 	LabelFn      func(*gorm.DB, Action) []string
+
+	// InFlightGauge, when set, is incremented in start and decremented in
+	// observeMetrics, labeled by InFlightLabels. Set to nil to disable it.
+	InFlightGauge *prometheus.GaugeVec
+	// RowsAffectedCounter, when set, is incremented by
+	// db.Statement.RowsAffected for write actions, labeled the same as
+	// HistogramVec. Set to nil to disable it.
+	RowsAffectedCounter *prometheus.CounterVec
+
+	// ErrorClassifier, when set, is consulted for the error_kind label by
+	// the label function DefaultWithErrorKind() configures. It receives
+	// db.Error and returns a short classification such as "timeout" or
+	// "unique_violation", or "" to leave error_kind empty. Defaults to nil,
+	// which preserves the current label set when using a custom LabelFn.
+	ErrorClassifier func(error) string
+
+	// CustomMetrics lists additional metrics to register and populate
+	// alongside HistogramVec. See CustomMetric for the per-metric options.
+	CustomMetrics []*CustomMetric
+	// Registerer is the Prometheus registerer used for CustomMetrics.
+	// Defaults to prometheus.DefaultRegisterer when nil.
+	Registerer prometheus.Registerer
+
+	// Tracer, when set, causes the start/observeMetrics callbacks to also
+	// open and end an OpenTelemetry span ("gorm.<action>") for every GORM
+	// operation. TracerProvider is used instead when Tracer is nil; leave
+	// both nil to disable tracing entirely.
+	Tracer         trace.Tracer
+	TracerProvider trace.TracerProvider
+
+	// RecordSQL controls whether the span gets a db.statement attribute at
+	// all. Defaults to false, since SQL text may contain sensitive literals.
+	RecordSQL bool
+	// SQLRedactor, when RecordSQL is true, is applied to the SQL text before
+	// it is attached to the span, so callers can scrub literals.
+	SQLRedactor func(string) string
+
+	// TTL, when non-zero, expires label combinations that have not been observed
+	// for longer than TTL by deleting them from HistogramVec. A zero value (the
+	// default) means labels never expire, preserving the original behavior.
+	TTL time.Duration
+
+	// JanitorInterval controls how often the TTL janitor sweeps for stale label
+	// combinations. Defaults to defaultJanitorInterval when TTL is set and this
+	// is left zero.
+	JanitorInterval time.Duration
+
+	labelMu  sync.Mutex
+	lastSeen map[string]*labelSeen
+	stopCh   chan struct{}
+	janitor  sync.WaitGroup
+}
+
+// labelSeen tracks the label values and last-observed time for a single series,
+// so the TTL janitor can call HistogramVec.DeleteLabelValues on expiry.
+type labelSeen struct {
+	values []string
+	at     time.Time
 }
 
+// MetricContextValue holds the per-statement state GormMetrics threads
+// through a single Before/After callback pair. start builds a fresh
+// MetricContextValue for every statement and never mutates one it finds on
+// an incoming context: a context created by WithName/WithNameContext can be
+// reused by the caller across concurrent statements on the same named
+// session, and mutating shared state in that case would race span and
+// inFlightDecremented between them. Only the name is ever carried over from
+// such a context.
 type MetricContextValue struct {
 	startTime time.Time
 	name      string
+	span      trace.Span
+
+	// inFlightDecremented guards InFlightGauge against being decremented
+	// more than once for a single statement, should observeMetrics ever
+	// fire twice for the same context.
+	inFlightDecremented bool
 }
 
 func (m *MetricContextValue) Name() string {
@@ -101,30 +253,156 @@ var (
 		MetricLabels,
 	)
 
+	// defaultInFlightGauge is the default Prometheus gauge vector tracking
+	// in-flight GORM operations.
+	defaultInFlightGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: InFlightMetricName,
+			Help: "Number of GORM operations currently in flight",
+		},
+		InFlightLabels,
+	)
+
+	// defaultRowsAffectedCounter is the default Prometheus counter vector
+	// tracking rows affected by write operations.
+	defaultRowsAffectedCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: RowsAffectedMetricName,
+			Help: "Total rows affected by GORM write operations",
+		},
+		MetricLabels,
+	)
+
 	// defaultPlugin is the default GormMetrics instance with default settings.
 	defaultPlugin = &GormMetrics{
-		HistogramVec: defaultHistogramVec,
-		LabelFn:      defaultLabelFn,
+		HistogramVec:        defaultHistogramVec,
+		LabelFn:             defaultLabelFn,
+		InFlightGauge:       defaultInFlightGauge,
+		RowsAffectedCounter: defaultRowsAffectedCounter,
+	}
+
+	// defaultErrorKindHistogramVec backs DefaultWithErrorKind(). It uses its
+	// own metric name (distinct from GormMetricName) since it carries the
+	// extra error_kind label and registering two descriptors with the same
+	// name but different label sets panics on the default registry.
+	defaultErrorKindHistogramVec = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    GormMetricNameErrorKind,
+			Help:    "Duration of GORM operations in seconds, with error classification",
+			Buckets: prometheus.DefBuckets,
+		},
+		MetricLabelsWithErrorKind,
+	)
+
+	// defaultErrorKindPlugin is the GormMetrics instance returned by
+	// DefaultWithErrorKind().
+	defaultErrorKindPlugin = &GormMetrics{
+		HistogramVec:    defaultErrorKindHistogramVec,
+		ErrorClassifier: StandardErrorClassifier,
 	}
 )
 
+func init() {
+	defaultErrorKindPlugin.LabelFn = defaultErrorKindPlugin.errorKindLabelFn
+}
+
 // Default returns a new GormMetrics instance with default settings.
-// It registers the default histogram to the default Prometheus registry on the first call.
+// It registers the default histogram, in-flight gauge, and rows-affected
+// counter to the default Prometheus registry on the first call.
 //
 // If you need to customize the metric or use different prometheus registry, create a
 // new GormMetrics instance instead.
 func Default() *GormMetrics {
-	err := prometheus.Register(defaultHistogramVec)
-	if err != nil && !errors.As(err, &prometheus.AlreadyRegisteredError{}) {
-		panic(fmt.Sprintf("failed to register default GormMetrics histogram: %+v", err))
+	for _, collector := range []prometheus.Collector{defaultHistogramVec, defaultInFlightGauge, defaultRowsAffectedCounter} {
+		err := prometheus.Register(collector)
+		if err != nil && !errors.As(err, &prometheus.AlreadyRegisteredError{}) {
+			panic(fmt.Sprintf("failed to register default GormMetrics collector: %+v", err))
+		}
 	}
 	return defaultPlugin
 }
 
+// DefaultWithErrorKind returns a GormMetrics instance whose label set adds
+// error_kind (MetricLabelsWithErrorKind) alongside the usual labels,
+// classified by ErrorClassifier (StandardErrorClassifier by default).
+// It registers its own histogram to the default Prometheus registry on the
+// first call.
+//
+// Because this changes the default label set, it is opt-in: existing code
+// calling Default() keeps the original label set, metric name, and
+// dashboards. Default() and DefaultWithErrorKind() can be used together in
+// the same process; they register distinct metrics (GormMetricName vs.
+// GormMetricNameErrorKind).
+func DefaultWithErrorKind() *GormMetrics {
+	err := prometheus.Register(defaultErrorKindHistogramVec)
+	if err != nil && !errors.As(err, &prometheus.AlreadyRegisteredError{}) {
+		panic(fmt.Sprintf("failed to register default GormMetrics collector: %+v", err))
+	}
+	return defaultErrorKindPlugin
+}
+
+// errorKindLabelFn is the label function used by DefaultWithErrorKind(). It
+// extends defaultLabelFn with error_kind, derived from g.ErrorClassifier.
+func (g *GormMetrics) errorKindLabelFn(db *gorm.DB, action Action) []string {
+	labels := defaultLabelFn(db, action)
+
+	kind := ""
+	if g.ErrorClassifier != nil && db.Error != nil {
+		kind = g.ErrorClassifier(db.Error)
+	}
+
+	return append(labels, kind)
+}
+
+// StandardErrorClassifier classifies the handful of driver-agnostic errors
+// GORM itself can produce. It is the default ErrorClassifier used by
+// DefaultWithErrorKind(); combine it with driver-specific classifiers via
+// ChainErrorClassifiers to also cover errors like *pq.Error or
+// *mysql.MySQLError.
+func StandardErrorClassifier(err error) string {
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		return "record_not_found"
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	case errors.Is(err, context.DeadlineExceeded):
+		return "timeout"
+	default:
+		return ""
+	}
+}
+
+// ChainErrorClassifiers combines multiple error classifiers into one,
+// returning the first non-empty classification. This lets callers register
+// driver-specific handlers (e.g. for *pq.Error, *mysql.MySQLError,
+// sqlite3.Error) alongside StandardErrorClassifier:
+//
+//	plugin.ErrorClassifier = gm.ChainErrorClassifiers(classifyPQError, gm.StandardErrorClassifier)
+func ChainErrorClassifiers(classifiers ...func(error) string) func(error) string {
+	return func(err error) string {
+		for _, classify := range classifiers {
+			if classify == nil {
+				continue
+			}
+			if kind := classify(err); kind != "" {
+				return kind
+			}
+		}
+		return ""
+	}
+}
+
 func (g *GormMetrics) Name() string {
 	return PluginName
 }
 
+// DefaultLabelFn is the label function used by Default(). It is exported so
+// custom GormMetrics instances (e.g. ones built to add a TTL) can reuse the
+// same label derivation without duplicating it.
+func DefaultLabelFn(db *gorm.DB, action Action) []string {
+	return defaultLabelFn(db, action)
+}
+
 // WithName returns a context with a metric name set, which can be used to
 // identify the operation in the metrics. Use this context when starting a GORM operation:
 //
@@ -138,9 +416,11 @@ func WithName(name string) context.Context {
 //
 //	db.WithContext(gm.WithNameContext(ctx, "my_update")).Model(&Thing{}).Update("name", "new name")
 func WithNameContext(ctx context.Context, name string) context.Context {
+	// start builds the per-statement MetricContextValue (startTime, span,
+	// inFlightDecremented); this one exists only to carry name across to it,
+	// so that the same WithName context can safely be reused concurrently.
 	return context.WithValue(ctx, GormMetricsContextKey, &MetricContextValue{
-		startTime: time.Now(),
-		name:      name,
+		name: name,
 	})
 }
 
@@ -150,13 +430,33 @@ func (g *GormMetrics) Initialize(db *gorm.DB) error {
 		return gorm.ErrInvalidDB
 	}
 
+	if g.TTL > 0 {
+		g.startJanitor()
+	}
+
+	if err := g.registerCustomMetrics(); err != nil {
+		return err
+	}
+
 	return anyErr(
-		db.Callback().Query().Before("*").Register("gorm-metrics:start", g.start),
-		db.Callback().Create().Before("*").Register("gorm-metrics:start", g.start),
-		db.Callback().Update().Before("*").Register("gorm-metrics:start", g.start),
-		db.Callback().Delete().Before("*").Register("gorm-metrics:start", g.start),
-		db.Callback().Raw().Before("*").Register("gorm-metrics:start", g.start),
-		db.Callback().Row().Before("*").Register("gorm-metrics:start", g.start),
+		db.Callback().Query().Before("*").Register("gorm-metrics:start", func(d *gorm.DB) {
+			g.start(d, ActionQuery)
+		}),
+		db.Callback().Create().Before("*").Register("gorm-metrics:start", func(d *gorm.DB) {
+			g.start(d, ActionCreate)
+		}),
+		db.Callback().Update().Before("*").Register("gorm-metrics:start", func(d *gorm.DB) {
+			g.start(d, ActionUpdate)
+		}),
+		db.Callback().Delete().Before("*").Register("gorm-metrics:start", func(d *gorm.DB) {
+			g.start(d, ActionDelete)
+		}),
+		db.Callback().Raw().Before("*").Register("gorm-metrics:start", func(d *gorm.DB) {
+			g.start(d, ActionRaw)
+		}),
+		db.Callback().Row().Before("*").Register("gorm-metrics:start", func(d *gorm.DB) {
+			g.start(d, ActionRow)
+		}),
 		db.Callback().Query().After("gorm:query").Register("gorm-metrics:query", func(d *gorm.DB) {
 			g.observeMetrics(d, ActionQuery)
 		}),
@@ -187,23 +487,343 @@ func (g *GormMetrics) observeMetrics(db *gorm.DB, action Action) {
 		return
 	}
 
-	g.HistogramVec.WithLabelValues(
-		g.LabelFn(db, action)...,
-	).Observe(time.Since(metricContext.startTime).Seconds())
+	labels := g.LabelFn(db, action)
+	elapsed := time.Since(metricContext.startTime).Seconds()
+
+	g.HistogramVec.WithLabelValues(labels...).Observe(elapsed)
+
+	if g.TTL > 0 {
+		g.touch(labels)
+	}
+
+	g.observeCustomMetrics(db, action, elapsed)
+
+	g.endSpan(db, metricContext)
+
+	if g.InFlightGauge != nil && !metricContext.inFlightDecremented {
+		g.InFlightGauge.WithLabelValues(inFlightLabelValues(db, action)...).Dec()
+		metricContext.inFlightDecremented = true
+	}
+
+	if g.RowsAffectedCounter != nil && isWriteAction(action) {
+		g.RowsAffectedCounter.WithLabelValues(labels...).Add(float64(db.Statement.RowsAffected))
+	}
 }
 
-func (g *GormMetrics) start(db *gorm.DB) {
+// isWriteAction reports whether action represents a GORM write operation,
+// i.e. one that can affect rows.
+func isWriteAction(action Action) bool {
+	switch action {
+	case ActionCreate, ActionUpdate, ActionDelete:
+		return true
+	default:
+		return false
+	}
+}
+
+// inFlightLabelValues computes the InFlightLabels values for a statement.
+// It mirrors the name/action/model portion of defaultLabelFn since joins and
+// outcome are not yet known while a statement is in flight.
+func inFlightLabelValues(db *gorm.DB, action Action) []string {
 	metricContext, ok := db.Statement.Context.Value(GormMetricsContextKey).(*MetricContextValue)
-	if !ok {
-		// If no metric context is set, we create a default one.
-		db.Statement.Context = context.WithValue(db.Statement.Context, GormMetricsContextKey, &MetricContextValue{
-			startTime: time.Now(),
-			name:      "default",
-		})
-	} else {
-		// If a metric context is already set, we update the start time.
-		metricContext.startTime = time.Now()
+	name := "default"
+	if ok {
+		name = metricContext.name
 	}
+
+	model := db.Statement.Table
+	if model == "" {
+		model = "unknown"
+	}
+
+	return []string{name, string(action), strings.ToLower(model)}
+}
+
+// endSpan finishes the span opened by start, if tracing is enabled,
+// attaching attributes describing the statement and its outcome.
+func (g *GormMetrics) endSpan(db *gorm.DB, metricContext *MetricContextValue) {
+	span := metricContext.span
+	if span == nil {
+		return
+	}
+	defer span.End()
+
+	model := strings.ToLower(db.Statement.Table)
+	if model == "" {
+		model = "unknown"
+	}
+
+	span.SetAttributes(
+		attribute.String("db.system", "gorm"),
+		attribute.String("db.sql.table", model),
+		attribute.Int("db.sql.joins", len(db.Statement.Joins)),
+		attribute.Int64("db.rows_affected", db.Statement.RowsAffected),
+	)
+
+	if g.RecordSQL {
+		sql := db.Statement.SQL.String()
+		if g.SQLRedactor != nil {
+			sql = g.SQLRedactor(sql)
+		}
+		span.SetAttributes(attribute.String("db.statement", sql))
+	}
+
+	if db.Error != nil {
+		span.RecordError(db.Error)
+		span.SetStatus(codes.Error, db.Error.Error())
+		return
+	}
+	span.SetStatus(codes.Ok, "")
+}
+
+// observeCustomMetrics dispatches an observation to every CustomMetric whose
+// Filter (if any) matches this callback invocation.
+func (g *GormMetrics) observeCustomMetrics(db *gorm.DB, action Action, elapsed float64) {
+	for _, cm := range g.CustomMetrics {
+		if cm == nil || cm.vec == nil {
+			continue
+		}
+		if cm.Filter != nil && !cm.Filter(db, action) {
+			continue
+		}
+
+		labelFn := cm.LabelFn
+		if labelFn == nil {
+			labelFn = g.LabelFn
+		}
+		labels := labelFn(db, action)
+		value := cm.value(db, action, elapsed)
+
+		switch vec := cm.vec.(type) {
+		case *prometheus.HistogramVec:
+			vec.WithLabelValues(labels...).Observe(value)
+		case *prometheus.SummaryVec:
+			vec.WithLabelValues(labels...).Observe(value)
+		case *prometheus.CounterVec:
+			vec.WithLabelValues(labels...).Add(value)
+		case *prometheus.GaugeVec:
+			vec.WithLabelValues(labels...).Set(value)
+		}
+	}
+}
+
+// value resolves the number to record for this observation: cm.Value when
+// set, otherwise elapsed seconds for Histogram/Summary or 1 for Counter.
+// Gauge has no default; registerCustomMetrics rejects a Gauge with no Value.
+func (cm *CustomMetric) value(db *gorm.DB, action Action, elapsed float64) float64 {
+	if cm.Value != nil {
+		return cm.Value(db, action, elapsed)
+	}
+	if cm.Type == MetricTypeCounter {
+		return 1
+	}
+	return elapsed
+}
+
+// registerCustomMetrics creates and registers the Prometheus collector for
+// each entry in g.CustomMetrics, reusing an already-registered collector of
+// the same type when one exists.
+func (g *GormMetrics) registerCustomMetrics() error {
+	if len(g.CustomMetrics) == 0 {
+		return nil
+	}
+
+	registerer := g.Registerer
+	if registerer == nil {
+		registerer = prometheus.DefaultRegisterer
+	}
+
+	for _, cm := range g.CustomMetrics {
+		if cm == nil {
+			continue
+		}
+
+		labels := cm.Labels
+		if labels == nil {
+			labels = MetricLabels
+		}
+
+		var (
+			collector prometheus.Collector
+			are       prometheus.AlreadyRegisteredError
+		)
+
+		switch cm.Type {
+		case MetricTypeHistogram:
+			buckets := cm.Buckets
+			if buckets == nil {
+				buckets = prometheus.DefBuckets
+			}
+			vec := prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: cm.Name, Help: cm.Help, Buckets: buckets}, labels)
+			if err := registerer.Register(vec); err != nil {
+				if !errors.As(err, &are) {
+					return err
+				}
+				vec = are.ExistingCollector.(*prometheus.HistogramVec)
+			}
+			collector = vec
+		case MetricTypeSummary:
+			vec := prometheus.NewSummaryVec(prometheus.SummaryOpts{Name: cm.Name, Help: cm.Help, Objectives: cm.Objectives}, labels)
+			if err := registerer.Register(vec); err != nil {
+				if !errors.As(err, &are) {
+					return err
+				}
+				vec = are.ExistingCollector.(*prometheus.SummaryVec)
+			}
+			collector = vec
+		case MetricTypeCounter:
+			vec := prometheus.NewCounterVec(prometheus.CounterOpts{Name: cm.Name, Help: cm.Help}, labels)
+			if err := registerer.Register(vec); err != nil {
+				if !errors.As(err, &are) {
+					return err
+				}
+				vec = are.ExistingCollector.(*prometheus.CounterVec)
+			}
+			collector = vec
+		case MetricTypeGauge:
+			if cm.Value == nil {
+				return fmt.Errorf("gorm-metrics: custom gauge metric %q requires Value, since a duration has no sane default for a gauge", cm.Name)
+			}
+			vec := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: cm.Name, Help: cm.Help}, labels)
+			if err := registerer.Register(vec); err != nil {
+				if !errors.As(err, &are) {
+					return err
+				}
+				vec = are.ExistingCollector.(*prometheus.GaugeVec)
+			}
+			collector = vec
+		default:
+			return fmt.Errorf("gorm-metrics: unknown custom metric type %q for metric %q", cm.Type, cm.Name)
+		}
+
+		cm.vec = collector
+	}
+
+	return nil
+}
+
+// touch records the current time as the last-seen time for the given label
+// combination, so the janitor can later expire it once it has aged past TTL.
+func (g *GormMetrics) touch(labels []string) {
+	key := strings.Join(labels, "\x1f")
+
+	g.labelMu.Lock()
+	defer g.labelMu.Unlock()
+
+	if g.lastSeen == nil {
+		g.lastSeen = make(map[string]*labelSeen)
+	}
+	g.lastSeen[key] = &labelSeen{values: labels, at: time.Now()}
+}
+
+// startJanitor launches the background goroutine that expires label
+// combinations older than TTL. It is a no-op if already running.
+func (g *GormMetrics) startJanitor() {
+	g.labelMu.Lock()
+	if g.stopCh != nil {
+		g.labelMu.Unlock()
+		return
+	}
+	if g.lastSeen == nil {
+		g.lastSeen = make(map[string]*labelSeen)
+	}
+	g.stopCh = make(chan struct{})
+	stopCh := g.stopCh
+	g.labelMu.Unlock()
+
+	interval := g.JanitorInterval
+	if interval <= 0 {
+		interval = defaultJanitorInterval
+	}
+
+	g.janitor.Add(1)
+	go func() {
+		defer g.janitor.Done()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				g.expireStaleLabels()
+			case <-stopCh:
+				return
+			}
+		}
+	}()
+}
+
+// expireStaleLabels deletes any tracked label combination whose last
+// observation is older than TTL from HistogramVec.
+func (g *GormMetrics) expireStaleLabels() {
+	now := time.Now()
+
+	g.labelMu.Lock()
+	defer g.labelMu.Unlock()
+
+	for key, seen := range g.lastSeen {
+		if now.Sub(seen.at) < g.TTL {
+			continue
+		}
+		g.HistogramVec.DeleteLabelValues(seen.values...)
+		delete(g.lastSeen, key)
+	}
+}
+
+// Close stops the TTL janitor goroutine, if one is running. It is safe to
+// call on a GormMetrics instance that never started a janitor (TTL == 0).
+func (g *GormMetrics) Close() error {
+	g.labelMu.Lock()
+	stopCh := g.stopCh
+	g.stopCh = nil
+	g.labelMu.Unlock()
+
+	if stopCh == nil {
+		return nil
+	}
+	close(stopCh)
+	g.janitor.Wait()
+	return nil
+}
+
+func (g *GormMetrics) start(db *gorm.DB, action Action) {
+	ctx := db.Statement.Context
+
+	// Carry the name over from an existing context, but always build a new
+	// MetricContextValue: see the MetricContextValue doc comment for why we
+	// never mutate one found on ctx.
+	name := "default"
+	if existing, ok := ctx.Value(GormMetricsContextKey).(*MetricContextValue); ok {
+		name = existing.name
+	}
+	metricContext := &MetricContextValue{
+		startTime: time.Now(),
+		name:      name,
+	}
+
+	if tracer := g.tracer(); tracer != nil {
+		ctx, metricContext.span = tracer.Start(ctx, "gorm."+string(action))
+	}
+
+	if g.InFlightGauge != nil {
+		g.InFlightGauge.WithLabelValues(inFlightLabelValues(db, action)...).Inc()
+	}
+
+	db.Statement.Context = context.WithValue(ctx, GormMetricsContextKey, metricContext)
+}
+
+// tracer returns the trace.Tracer to use for span emission, preferring an
+// explicitly set Tracer over one derived from TracerProvider. Returns nil
+// when neither is configured, leaving tracing disabled.
+func (g *GormMetrics) tracer() trace.Tracer {
+	if g.Tracer != nil {
+		return g.Tracer
+	}
+	if g.TracerProvider != nil {
+		return g.TracerProvider.Tracer(PluginName)
+	}
+	return nil
 }
 
 func anyErr(err ...error) error {
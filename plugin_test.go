@@ -1,12 +1,20 @@
 package gm_test
 
 import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	io_prometheus_client "github.com/prometheus/client_model/go"
 	gm "github.com/tpokki/gorm-metrics"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
 )
@@ -244,3 +252,469 @@ func TestCustomHistogram(t *testing.T) {
 		t.Fatalf("expected sample count to be 1, got %d", value.GetHistogram().GetSampleCount())
 	}
 }
+
+func TestTTLExpiration(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("failed to open gorm DB: %v", err)
+	}
+
+	plugin := &gm.GormMetrics{
+		HistogramVec: promauto.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "gorm_ttl_metric",
+			Help:    "GORM metric used to exercise TTL expiration",
+			Buckets: prometheus.DefBuckets,
+		}, gm.MetricLabels),
+		LabelFn:         gm.DefaultLabelFn,
+		TTL:             20 * time.Millisecond,
+		JanitorInterval: 5 * time.Millisecond,
+	}
+	defer plugin.Close()
+
+	if err := db.Use(plugin); err != nil {
+		t.Fatalf("failed to use plugin: %v", err)
+	}
+	if err := db.AutoMigrate(&Person{}); err != nil {
+		t.Fatalf("failed to auto migrate: %v", err)
+	}
+
+	person := &Person{Name: "Ted", Age: 50}
+	if err := db.Create(person).Error; err != nil {
+		t.Fatalf("failed to create test model: %v", err)
+	}
+
+	metric, err := plugin.HistogramVec.MetricVec.GetMetricWithLabelValues("default", "create", "people", "0", "success")
+	if err != nil {
+		t.Fatalf("failed to get metric: %v", err)
+	}
+	var value io_prometheus_client.Metric
+	if err := metric.Write(&value); err != nil {
+		t.Fatalf("failed to write metric: %v", err)
+	}
+	if value.GetHistogram().GetSampleCount() != 1 {
+		t.Fatalf("expected sample count to be 1 before expiry, got %d", value.GetHistogram().GetSampleCount())
+	}
+
+	time.Sleep(50 * time.Millisecond)
+
+	metric, err = plugin.HistogramVec.MetricVec.GetMetricWithLabelValues("default", "create", "people", "0", "success")
+	if err != nil {
+		t.Fatalf("failed to get metric after expiry: %v", err)
+	}
+	if err := metric.Write(&value); err != nil {
+		t.Fatalf("failed to write metric after expiry: %v", err)
+	}
+	if value.GetHistogram().GetSampleCount() != 0 {
+		t.Fatalf("expected sample count to be reset to 0 after TTL expiry, got %d", value.GetHistogram().GetSampleCount())
+	}
+}
+
+func TestTTLReRegistrationAfterExpiry(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("failed to open gorm DB: %v", err)
+	}
+
+	plugin := &gm.GormMetrics{
+		HistogramVec: promauto.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "gorm_ttl_reregister_metric",
+			Help:    "GORM metric used to exercise re-registration after TTL expiry",
+			Buckets: prometheus.DefBuckets,
+		}, gm.MetricLabels),
+		LabelFn:         gm.DefaultLabelFn,
+		TTL:             20 * time.Millisecond,
+		JanitorInterval: 5 * time.Millisecond,
+	}
+	defer plugin.Close()
+
+	if err := db.Use(plugin); err != nil {
+		t.Fatalf("failed to use plugin: %v", err)
+	}
+	if err := db.AutoMigrate(&Person{}); err != nil {
+		t.Fatalf("failed to auto migrate: %v", err)
+	}
+
+	person := &Person{Name: "Nora", Age: 22}
+	if err := db.Create(person).Error; err != nil {
+		t.Fatalf("failed to create test model: %v", err)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+
+	// Re-observe the same label combination after it has expired.
+	if err := db.Create(&Person{Name: "Nils", Age: 23}).Error; err != nil {
+		t.Fatalf("failed to create second test model: %v", err)
+	}
+
+	metric, err := plugin.HistogramVec.MetricVec.GetMetricWithLabelValues("default", "create", "people", "0", "success")
+	if err != nil {
+		t.Fatalf("failed to get metric: %v", err)
+	}
+	var value io_prometheus_client.Metric
+	if err := metric.Write(&value); err != nil {
+		t.Fatalf("failed to write metric: %v", err)
+	}
+	if value.GetHistogram().GetSampleCount() != 1 {
+		t.Fatalf("expected sample count to be 1 after re-registration, got %d", value.GetHistogram().GetSampleCount())
+	}
+}
+
+func TestCustomMetrics(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("failed to open gorm DB: %v", err)
+	}
+
+	rowsAffected := &gm.CustomMetric{
+		Type:   gm.MetricTypeCounter,
+		Name:   "gorm_custom_rows_affected_total",
+		Help:   "Custom counter exercising per-metric filters and a Value func",
+		Labels: []string{"action"},
+		LabelFn: func(db *gorm.DB, action gm.Action) []string {
+			return []string{string(action)}
+		},
+		Filter: func(db *gorm.DB, action gm.Action) bool {
+			return action == gm.ActionUpdate || action == gm.ActionDelete
+		},
+		Value: func(db *gorm.DB, action gm.Action, elapsed float64) float64 {
+			return float64(db.Statement.RowsAffected)
+		},
+	}
+	errorsTotal := &gm.CustomMetric{
+		Type:   gm.MetricTypeCounter,
+		Name:   "gorm_custom_errors_total",
+		Help:   "Custom counter that only fires on error",
+		Labels: []string{"action"},
+		LabelFn: func(db *gorm.DB, action gm.Action) []string {
+			return []string{string(action)}
+		},
+		Filter: func(db *gorm.DB, action gm.Action) bool {
+			return db.Error != nil
+		},
+	}
+
+	plugin := &gm.GormMetrics{
+		HistogramVec: promauto.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "gorm_custom_metrics_duration_seconds",
+			Help:    "GORM metric used to exercise CustomMetrics",
+			Buckets: prometheus.DefBuckets,
+		}, gm.MetricLabels),
+		LabelFn:       gm.DefaultLabelFn,
+		CustomMetrics: []*gm.CustomMetric{rowsAffected, errorsTotal},
+	}
+
+	if err := db.Use(plugin); err != nil {
+		t.Fatalf("failed to use plugin: %v", err)
+	}
+	if err := db.AutoMigrate(&Person{}); err != nil {
+		t.Fatalf("failed to auto migrate: %v", err)
+	}
+
+	first := &Person{Name: "Cass", Age: 33}
+	if err := db.Create(first).Error; err != nil {
+		t.Fatalf("failed to create test model: %v", err)
+	}
+	second := &Person{Name: "Dale", Age: 33}
+	if err := db.Create(second).Error; err != nil {
+		t.Fatalf("failed to create test model: %v", err)
+	}
+
+	// A single UPDATE statement affecting two rows: the rows-affected
+	// counter should record 2 (the sum), not 1 (the number of statements).
+	if err := db.Model(&Person{}).Where("age = ?", 33).Update("age", 34).Error; err != nil {
+		t.Fatalf("failed to update test models: %v", err)
+	}
+	if err := db.First(&Person{}, "name = ?", "missing").Error; err == nil {
+		t.Fatalf("expected query against missing row to fail")
+	}
+
+	var value io_prometheus_client.Metric
+
+	metric, err := rowsAffected.Collector().(*prometheus.CounterVec).GetMetricWithLabelValues("update")
+	if err != nil {
+		t.Fatalf("failed to get rows-affected metric: %v", err)
+	}
+	if err := metric.Write(&value); err != nil {
+		t.Fatalf("failed to write rows-affected metric: %v", err)
+	}
+	if value.GetCounter().GetValue() != 2 {
+		t.Fatalf("expected rows-affected counter to sum to 2, got %v", value.GetCounter().GetValue())
+	}
+
+	metric, err = errorsTotal.Collector().(*prometheus.CounterVec).GetMetricWithLabelValues("query")
+	if err != nil {
+		t.Fatalf("failed to get errors metric: %v", err)
+	}
+	if err := metric.Write(&value); err != nil {
+		t.Fatalf("failed to write errors metric: %v", err)
+	}
+	if value.GetCounter().GetValue() != 1 {
+		t.Fatalf("expected errors counter to be 1, got %v", value.GetCounter().GetValue())
+	}
+
+	// create should not have incremented either filtered metric.
+	metric, err = rowsAffected.Collector().(*prometheus.CounterVec).GetMetricWithLabelValues("create")
+	if err != nil {
+		t.Fatalf("failed to get rows-affected metric for create: %v", err)
+	}
+	if err := metric.Write(&value); err != nil {
+		t.Fatalf("failed to write rows-affected metric for create: %v", err)
+	}
+	if value.GetCounter().GetValue() != 0 {
+		t.Fatalf("expected rows-affected counter for create to be 0, got %v", value.GetCounter().GetValue())
+	}
+}
+
+// noopTracer is a minimal trace.Tracer used to verify that GormMetrics opens
+// and ends a span per statement without pulling in the OpenTelemetry SDK.
+// started/ended are accessed with atomic ops so it can be shared across the
+// goroutines in TestNamedContextConcurrentReuse.
+type noopTracer struct {
+	trace.Tracer
+	started atomic.Int64
+	ended   atomic.Int64
+}
+
+func (t *noopTracer) Start(ctx context.Context, spanName string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	t.started.Add(1)
+	span := &countingSpan{tracer: t}
+	return trace.ContextWithSpan(ctx, span), span
+}
+
+type countingSpan struct {
+	trace.Span
+	tracer *noopTracer
+}
+
+func (s *countingSpan) End(opts ...trace.SpanEndOption) {
+	s.tracer.ended.Add(1)
+}
+
+func (s *countingSpan) SetAttributes(kv ...attribute.KeyValue)           {}
+func (s *countingSpan) SetStatus(code codes.Code, description string)    {}
+func (s *countingSpan) RecordError(err error, opts ...trace.EventOption) {}
+
+func TestTracingEmitsSpanPerStatement(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("failed to open gorm DB: %v", err)
+	}
+
+	tracer := &noopTracer{}
+	plugin := &gm.GormMetrics{
+		HistogramVec: promauto.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "gorm_tracing_metric",
+			Help:    "GORM metric used to exercise span emission",
+			Buckets: prometheus.DefBuckets,
+		}, gm.MetricLabels),
+		LabelFn: gm.DefaultLabelFn,
+		Tracer:  tracer,
+	}
+
+	if err := db.Use(plugin); err != nil {
+		t.Fatalf("failed to use plugin: %v", err)
+	}
+	if err := db.AutoMigrate(&Person{}); err != nil {
+		t.Fatalf("failed to auto migrate: %v", err)
+	}
+
+	// Reset so the assertion below only counts the Create under test, not
+	// the statements AutoMigrate itself issued.
+	tracer.started.Store(0)
+	tracer.ended.Store(0)
+
+	person := &Person{Name: "Mira", Age: 28}
+	if err := db.Create(person).Error; err != nil {
+		t.Fatalf("failed to create test model: %v", err)
+	}
+
+	if tracer.started.Load() != 1 || tracer.ended.Load() != 1 {
+		t.Fatalf("expected exactly one span started and ended, got started=%d ended=%d", tracer.started.Load(), tracer.ended.Load())
+	}
+}
+
+// TestNamedContextConcurrentReuse verifies that statements sharing a single
+// gm.WithName context concurrently each get their own span and in-flight
+// accounting rather than corrupting each other's MetricContextValue: see the
+// MetricContextValue doc comment.
+func TestNamedContextConcurrentReuse(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("failed to open gorm DB: %v", err)
+	}
+	// Keep every statement on the same connection so concurrent goroutines
+	// share one in-memory database instead of each getting their own.
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatalf("failed to get underlying sql.DB: %v", err)
+	}
+	sqlDB.SetMaxOpenConns(1)
+
+	tracer := &noopTracer{}
+	plugin := &gm.GormMetrics{
+		HistogramVec: promauto.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "gorm_named_context_reuse_metric",
+			Help:    "GORM metric used to exercise concurrent reuse of a named context",
+			Buckets: prometheus.DefBuckets,
+		}, gm.MetricLabels),
+		LabelFn:       gm.DefaultLabelFn,
+		Tracer:        tracer,
+		InFlightGauge: promauto.NewGaugeVec(prometheus.GaugeOpts{Name: "gorm_named_context_reuse_in_flight"}, gm.InFlightLabels),
+	}
+
+	if err := db.Use(plugin); err != nil {
+		t.Fatalf("failed to use plugin: %v", err)
+	}
+	if err := db.AutoMigrate(&Person{}); err != nil {
+		t.Fatalf("failed to auto migrate: %v", err)
+	}
+	tracer.started.Store(0)
+	tracer.ended.Store(0)
+
+	const concurrency = 20
+	ctx := gm.WithName("shared_session")
+
+	var wg sync.WaitGroup
+	wg.Add(concurrency)
+	for i := 0; i < concurrency; i++ {
+		go func(i int) {
+			defer wg.Done()
+			person := &Person{Name: "Reuse", Age: i}
+			if err := db.WithContext(ctx).Create(person).Error; err != nil {
+				t.Errorf("failed to create person model: %v", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if tracer.started.Load() != concurrency || tracer.ended.Load() != concurrency {
+		t.Fatalf("expected %d spans started and ended, got started=%d ended=%d", concurrency, tracer.started.Load(), tracer.ended.Load())
+	}
+
+	metric, err := plugin.InFlightGauge.GetMetricWithLabelValues("shared_session", "create", "people")
+	if err != nil {
+		t.Fatalf("failed to get in-flight metric: %v", err)
+	}
+	var value io_prometheus_client.Metric
+	if err := metric.Write(&value); err != nil {
+		t.Fatalf("failed to write in-flight metric: %v", err)
+	}
+	if value.GetGauge().GetValue() != 0 {
+		t.Fatalf("expected in-flight gauge to return to 0, got %v", value.GetGauge().GetValue())
+	}
+}
+
+func TestInFlightGaugeAndRowsAffectedCounter(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("failed to open gorm DB: %v", err)
+	}
+
+	plugin := &gm.GormMetrics{
+		HistogramVec: promauto.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "gorm_in_flight_test_duration_seconds",
+			Help:    "GORM metric used to exercise the in-flight gauge and rows-affected counter",
+			Buckets: prometheus.DefBuckets,
+		}, gm.MetricLabels),
+		LabelFn: gm.DefaultLabelFn,
+		InFlightGauge: promauto.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "gorm_in_flight_test",
+			Help: "In-flight gauge used in tests",
+		}, gm.InFlightLabels),
+		RowsAffectedCounter: promauto.NewCounterVec(prometheus.CounterOpts{
+			Name: "gorm_rows_affected_test_total",
+			Help: "Rows-affected counter used in tests",
+		}, gm.MetricLabels),
+	}
+
+	if err := db.Use(plugin); err != nil {
+		t.Fatalf("failed to use plugin: %v", err)
+	}
+	if err := db.AutoMigrate(&Person{}); err != nil {
+		t.Fatalf("failed to auto migrate: %v", err)
+	}
+
+	person := &Person{Name: "Owen", Age: 45}
+	if err := db.Create(person).Error; err != nil {
+		t.Fatalf("failed to create test model: %v", err)
+	}
+	if err := db.Model(person).Update("age", 46).Error; err != nil {
+		t.Fatalf("failed to update test model: %v", err)
+	}
+
+	var value io_prometheus_client.Metric
+
+	// the gauge should be back at 0 once every statement has completed.
+	metric, err := plugin.InFlightGauge.GetMetricWithLabelValues("default", "create", "people")
+	if err != nil {
+		t.Fatalf("failed to get in-flight metric: %v", err)
+	}
+	if err := metric.Write(&value); err != nil {
+		t.Fatalf("failed to write in-flight metric: %v", err)
+	}
+	if value.GetGauge().GetValue() != 0 {
+		t.Fatalf("expected in-flight gauge to settle back at 0, got %v", value.GetGauge().GetValue())
+	}
+
+	counter, err := plugin.RowsAffectedCounter.GetMetricWithLabelValues("default", "update", "people", "0", "success")
+	if err != nil {
+		t.Fatalf("failed to get rows-affected metric: %v", err)
+	}
+	if err := counter.Write(&value); err != nil {
+		t.Fatalf("failed to write rows-affected metric: %v", err)
+	}
+	if value.GetCounter().GetValue() != 1 {
+		t.Fatalf("expected rows-affected counter to be 1, got %v", value.GetCounter().GetValue())
+	}
+}
+
+func TestDefaultWithErrorKind(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("failed to open gorm DB: %v", err)
+	}
+
+	plugin := gm.DefaultWithErrorKind()
+	if err := db.Use(plugin); err != nil {
+		t.Fatalf("failed to use plugin: %v", err)
+	}
+	if err := db.AutoMigrate(&Person{}); err != nil {
+		t.Fatalf("failed to auto migrate: %v", err)
+	}
+
+	if err := db.First(&Person{}, "name = ?", "nobody").Error; err == nil {
+		t.Fatalf("expected query against missing row to fail")
+	}
+
+	var value io_prometheus_client.Metric
+	metric, err := plugin.HistogramVec.MetricVec.GetMetricWithLabelValues("default", "query", "people", "0", "error", "record_not_found")
+	if err != nil {
+		t.Fatalf("failed to get metric: %v", err)
+	}
+	if err := metric.Write(&value); err != nil {
+		t.Fatalf("failed to write metric: %v", err)
+	}
+	if value.GetHistogram().GetSampleCount() != 1 {
+		t.Fatalf("expected sample count to be 1, got %d", value.GetHistogram().GetSampleCount())
+	}
+}
+
+func TestChainErrorClassifiers(t *testing.T) {
+	sentinel := errors.New("boom")
+	classifier := gm.ChainErrorClassifiers(
+		func(err error) string {
+			if errors.Is(err, sentinel) {
+				return "boom_kind"
+			}
+			return ""
+		},
+		gm.StandardErrorClassifier,
+	)
+
+	if kind := classifier(sentinel); kind != "boom_kind" {
+		t.Fatalf("expected chained classifier to return boom_kind, got %q", kind)
+	}
+	if kind := classifier(gorm.ErrRecordNotFound); kind != "record_not_found" {
+		t.Fatalf("expected fallback to StandardErrorClassifier, got %q", kind)
+	}
+}